@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadToken is the payload carried by a signed upload token: a scoped
+// grant for a single upload_id with its own quotas and expiry.
+type UploadToken struct {
+	UploadID    string   `json:"upload_id"`
+	MaxBytes    int64    `json:"max_bytes"`
+	MaxFiles    int      `json:"max_files"`
+	ExpiresAt   int64    `json:"expires_at"`
+	AllowedMime []string `json:"allowed_mime,omitempty"`
+}
+
+// SignToken encodes and HMAC-SHA256 signs a token as "<payload>.<sig>",
+// both base64url without padding.
+func SignToken(secret []byte, token UploadToken) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	sig := mac.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyToken checks the signature and expiry of a token minted by SignToken.
+func VerifyToken(secret []byte, raw string) (UploadToken, error) {
+	var token UploadToken
+
+	parts := strings.SplitN(raw, ".", 2)
+	if len(parts) != 2 {
+		return token, errors.New("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return token, errors.New("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return token, errors.New("malformed token")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return token, errors.New("invalid token signature")
+	}
+
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return token, err
+	}
+	if token.ExpiresAt > 0 && time.Now().Unix() > token.ExpiresAt {
+		return token, errors.New("token expired")
+	}
+	return token, nil
+}
+
+// tokenUsage tracks how much of a token's quota has been spent.
+type tokenUsage struct {
+	BytesUsed int64 `json:"bytes_used"`
+	FilesUsed int   `json:"files_used"`
+}
+
+// TokenStore holds in-memory per-token usage counters, periodically flushed
+// to disk so counters survive a restart.
+type TokenStore struct {
+	path string
+
+	mu    sync.Mutex
+	usage map[string]*tokenUsage
+}
+
+func NewTokenStore(path string) *TokenStore {
+	s := &TokenStore{path: path, usage: map[string]*tokenUsage{}}
+	s.load()
+	go s.persistLoop()
+	return s
+}
+
+func (s *TokenStore) load() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	json.Unmarshal(data, &s.usage)
+}
+
+func (s *TokenStore) persistLoop() {
+	ticker := time.NewTicker(5 * time.Second)
+	for range ticker.C {
+		s.save()
+	}
+}
+
+func (s *TokenStore) save() {
+	s.mu.Lock()
+	data, err := json.Marshal(s.usage)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+	os.WriteFile(s.path, data, 0644)
+}
+
+// ReserveFile claims one of token's MaxFiles slots up front, before any
+// bytes are read, and reports how many bytes remain under MaxBytes so the
+// caller can bound its read. The file slot must be released with
+// ReleaseFile if the upload doesn't end up succeeding.
+func (s *TokenStore) ReserveFile(uploadID string, token UploadToken) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.usage[uploadID]
+	if u == nil {
+		u = &tokenUsage{}
+		s.usage[uploadID] = u
+	}
+
+	if token.MaxFiles > 0 && u.FilesUsed+1 > token.MaxFiles {
+		return 0, NewHttpError(413, "upload quota exceeded: too many files")
+	}
+
+	remaining := int64(math.MaxInt64)
+	if token.MaxBytes > 0 {
+		remaining = token.MaxBytes - u.BytesUsed
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+
+	u.FilesUsed++
+	return remaining, nil
+}
+
+// CommitBytes charges the actual bytes written by a previously reserved
+// upload against uploadID's quota.
+func (s *TokenStore) CommitBytes(uploadID string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.usage[uploadID]; u != nil {
+		u.BytesUsed += bytes
+	}
+}
+
+// ReleaseFile undoes a ReserveFile call for an upload that never completed,
+// so a rejected or failed file doesn't permanently consume a quota slot.
+func (s *TokenStore) ReleaseFile(uploadID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.usage[uploadID]; u != nil && u.FilesUsed > 0 {
+		u.FilesUsed--
+	}
+}
+
+// UploadAuth validates upload tokens and enforces their quotas.
+type UploadAuth struct {
+	Secret []byte
+	Store  *TokenStore
+}
+
+type tokenContextKey struct{}
+
+// RequireToken wraps an upload handler so that every request must carry a
+// valid, unexpired upload token, either as a `token` query param or an
+// `Authorization: Bearer` header.
+func (a *UploadAuth) RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("token")
+		if raw == "" {
+			raw = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if raw == "" {
+			writeError(w, NewHttpError(401, "Missing upload token"))
+			return
+		}
+
+		token, err := VerifyToken(a.Secret, raw)
+		if err != nil {
+			writeError(w, NewHttpError(401, err.Error()))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
+	})
+}
+
+// tokenFromContext returns the UploadToken attached by RequireToken, if any.
+func tokenFromContext(ctx context.Context) (UploadToken, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(UploadToken)
+	return token, ok
+}
+
+// quotaReader bounds reads to a byte budget, returning an HTTP 413 error
+// once the budget is exhausted instead of silently truncating the stream
+// the way io.LimitedReader would (which io.Copy sees as a clean EOF).
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.remaining <= 0 {
+		return 0, NewHttpError(413, "upload exceeds token's max_bytes quota")
+	}
+	if int64(len(p)) > q.remaining {
+		p = p[:q.remaining]
+	}
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// uploadQuota tracks a single upload's reservation against its token's
+// quota, from the moment it starts streaming to the moment it either
+// commits or is rolled back.
+type uploadQuota struct {
+	store    *TokenStore
+	uploadID string
+	budget   int64
+	reader   *quotaReader
+}
+
+// reserve claims a file slot for token up front and returns an uploadQuota
+// that bounds how many bytes may still be read for it. The file slot is
+// held until Commit or Rollback is called.
+func (a *UploadAuth) reserve(token UploadToken) (*uploadQuota, error) {
+	remaining, err := a.Store.ReserveFile(token.UploadID, token)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadQuota{store: a.Store, uploadID: token.UploadID, budget: remaining}, nil
+}
+
+// Wrap bounds r to the quota's remaining byte budget.
+func (q *uploadQuota) Wrap(r io.Reader) io.Reader {
+	q.reader = &quotaReader{r: r, remaining: q.budget}
+	return q.reader
+}
+
+// Commit charges the bytes actually read against the token's quota. Call
+// only after the file has been durably written.
+func (q *uploadQuota) Commit() {
+	used := q.budget - q.reader.remaining
+	q.store.CommitBytes(q.uploadID, used)
+}
+
+// Rollback releases the file slot reserved by reserve without charging any
+// bytes, for an upload that was rejected or failed before completion.
+func (q *uploadQuota) Rollback() {
+	q.store.ReleaseFile(q.uploadID)
+}
+
+// mintTokenHandler implements the admin `POST /tokens` endpoint, protected
+// by a static admin key from the environment.
+type mintTokenHandler struct {
+	AdminKey string
+	Secret   []byte
+}
+
+type mintTokenRequest struct {
+	MaxBytes    int64    `json:"max_bytes"`
+	MaxFiles    int      `json:"max_files"`
+	ExpiresIn   int64    `json:"expires_in_seconds"`
+	AllowedMime []string `json:"allowed_mime,omitempty"`
+}
+
+type mintTokenResponse struct {
+	Token    string `json:"token"`
+	UploadID string `json:"upload_id"`
+}
+
+func (h *mintTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, NewHttpError(404, "Not Found"))
+		return
+	}
+	if subtleCompare(r.Header.Get("X-Admin-Key"), h.AdminKey) == false {
+		writeError(w, NewHttpError(403, "Forbidden"))
+		return
+	}
+
+	var req mintTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, NewHttpError(400, "Invalid request body"))
+		return
+	}
+
+	uploadID, err := generateUploadID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	token := UploadToken{
+		UploadID:    uploadID,
+		MaxBytes:    req.MaxBytes,
+		MaxFiles:    req.MaxFiles,
+		AllowedMime: req.AllowedMime,
+	}
+	if req.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Unix() + req.ExpiresIn
+	}
+
+	signed, err := SignToken(h.Secret, token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mintTokenResponse{Token: signed, UploadID: uploadID})
+}
+
+func subtleCompare(a, b string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
+// writeError writes err to w, unwrapping *HttpError for its status code and
+// message the same way the upload handlers do.
+func writeError(w http.ResponseWriter, err error) {
+	code := 500
+	message := "Internal server error"
+	if v, ok := err.(*HttpError); ok {
+		code = v.StatusCode
+		message = v.Message
+	}
+	w.WriteHeader(code)
+	fmt.Fprint(w, message)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignVerifyTokenRoundTrip(t *testing.T) {
+	secret := []byte("test-secret")
+	token := UploadToken{
+		UploadID:    "abc123",
+		MaxBytes:    1024,
+		MaxFiles:    3,
+		AllowedMime: []string{"image/png"},
+	}
+
+	signed, err := SignToken(secret, token)
+	if err != nil {
+		t.Fatalf("SignToken: %v", err)
+	}
+
+	got, err := VerifyToken(secret, signed)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if got.UploadID != token.UploadID {
+		t.Fatalf("UploadID mismatch: got %q, want %q", got.UploadID, token.UploadID)
+	}
+	if got.MaxBytes != token.MaxBytes || got.MaxFiles != token.MaxFiles {
+		t.Fatalf("quota fields mismatch: got %+v, want %+v", got, token)
+	}
+	if len(got.AllowedMime) != 1 || got.AllowedMime[0] != "image/png" {
+		t.Fatalf("AllowedMime mismatch: got %+v", got.AllowedMime)
+	}
+}
+
+func TestVerifyTokenRejectsBadSignature(t *testing.T) {
+	secret := []byte("test-secret")
+	signed, err := SignToken(secret, UploadToken{UploadID: "abc123"})
+	if err != nil {
+		t.Fatalf("SignToken: %v", err)
+	}
+
+	if _, err := VerifyToken([]byte("wrong-secret"), signed); err == nil {
+		t.Fatal("expected an error verifying with the wrong secret")
+	}
+}
+
+func TestVerifyTokenRejectsExpired(t *testing.T) {
+	secret := []byte("test-secret")
+	token := UploadToken{UploadID: "abc123", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+
+	signed, err := SignToken(secret, token)
+	if err != nil {
+		t.Fatalf("SignToken: %v", err)
+	}
+
+	if _, err := VerifyToken(secret, signed); err == nil {
+		t.Fatal("expected an error verifying an expired token")
+	}
+}
+
+func TestTokenStoreReserveFileOverMaxFiles(t *testing.T) {
+	store := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	token := UploadToken{UploadID: "u1", MaxFiles: 2}
+
+	if _, err := store.ReserveFile(token.UploadID, token); err != nil {
+		t.Fatalf("1st ReserveFile: %v", err)
+	}
+	if _, err := store.ReserveFile(token.UploadID, token); err != nil {
+		t.Fatalf("2nd ReserveFile: %v", err)
+	}
+	if _, err := store.ReserveFile(token.UploadID, token); err == nil {
+		t.Fatal("expected 3rd ReserveFile to exceed MaxFiles")
+	}
+}
+
+func TestTokenStoreReserveFileTracksRemainingBytes(t *testing.T) {
+	store := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	token := UploadToken{UploadID: "u1", MaxBytes: 100, MaxFiles: 2}
+
+	remaining, err := store.ReserveFile(token.UploadID, token)
+	if err != nil {
+		t.Fatalf("ReserveFile: %v", err)
+	}
+	if remaining != 100 {
+		t.Fatalf("remaining = %d, want 100", remaining)
+	}
+
+	store.CommitBytes(token.UploadID, 60)
+
+	remaining, err = store.ReserveFile(token.UploadID, token)
+	if err != nil {
+		t.Fatalf("2nd ReserveFile: %v", err)
+	}
+	if remaining != 40 {
+		t.Fatalf("remaining after committing 60/100 = %d, want 40", remaining)
+	}
+}
+
+func TestTokenStoreReleaseFileRestoresSlot(t *testing.T) {
+	store := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	token := UploadToken{UploadID: "u1", MaxFiles: 1}
+
+	if _, err := store.ReserveFile(token.UploadID, token); err != nil {
+		t.Fatalf("ReserveFile: %v", err)
+	}
+	if _, err := store.ReserveFile(token.UploadID, token); err == nil {
+		t.Fatal("expected the file slot to already be exhausted")
+	}
+
+	store.ReleaseFile(token.UploadID)
+
+	if _, err := store.ReserveFile(token.UploadID, token); err != nil {
+		t.Fatalf("ReserveFile after ReleaseFile: %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -8,6 +11,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -27,6 +32,10 @@ type RequestLogger struct {
 
 type FileUploadHandler struct {
 	UploadDir string
+	Scanners  []UploadScanner
+	Auth      *UploadAuth
+	Storage   Storage
+	Events    *EventDispatcher
 }
 
 type FileUploadContext struct {
@@ -83,19 +92,32 @@ func (h *FileUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *FileUploadHandler) handleFileUpload(c *FileUploadContext) (*HttpResponse, error) {
-	logger := c.Logger
 	req := c.Request
 
-	if req.Method != "POST" {
+	switch req.Method {
+	case "POST":
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/") {
+			return h.handleMultipartUpload(c)
+		}
+		return h.handleRawUpload(c)
+	case "PUT":
+		return h.handleRawUpload(c)
+	default:
 		return nil, NewHttpError(404, "Not Found")
 	}
+}
+
+// handleMultipartUpload handles the traditional multipart/form-data flow,
+// where a request may carry multiple file parts.
+func (h *FileUploadHandler) handleMultipartUpload(c *FileUploadContext) (*HttpResponse, error) {
+	logger := c.Logger
+	req := c.Request
 
 	mr, err := req.MultipartReader()
 	if err != nil {
 		return nil, err
 	}
 
-	buf := make([]byte, 4096)
 	for {
 		part, err := mr.NextPart()
 		if err != nil {
@@ -105,55 +127,379 @@ func (h *FileUploadHandler) handleFileUpload(c *FileUploadContext) (*HttpRespons
 			break
 		}
 
+		var src io.Reader = part
+		var quota *uploadQuota
+		if h.Auth != nil {
+			token, _ := tokenFromContext(req.Context())
+			if len(token.AllowedMime) > 0 && !containsType(token.AllowedMime, part.Header.Get("Content-Type")) {
+				return nil, NewHttpError(415, "disallowed content type")
+			}
+			q, err := h.Auth.reserve(token)
+			if err != nil {
+				return nil, err
+			}
+			quota = q
+			src = quota.Wrap(part)
+		}
+
 		filename := h.createFilename(part)
-		f, err := h.createFile(filename)
+		size, sum, err := h.writeUpload(src, filename)
 		if err != nil {
+			if quota != nil {
+				quota.Rollback()
+			}
 			return nil, err
 		}
-		defer f.Close()
-
-		uploaded := false
-		for !uploaded {
-			n, err := part.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					return nil, err
-				}
-				uploaded = true
-			}
-			if _, err = f.Write(buf[:n]); err != nil {
-				return nil, err
-			}
+		if quota != nil {
+			quota.Commit()
 		}
 		logger.Printf("File uploaded: %s", filename)
+		h.dispatchUploadEvent(req, filename, size, sum, part.Header.Get("Content-Type"))
 	}
 
 	return &HttpResponse{200, "File uploaded"}, nil
 }
 
+// handleRawUpload handles a single file whose entire body is the upload,
+// for clients such as `curl -T` that don't want to build a multipart body.
+func (h *FileUploadHandler) handleRawUpload(c *FileUploadContext) (*HttpResponse, error) {
+	logger := c.Logger
+	req := c.Request
+
+	name := req.Header.Get("X-File-Name")
+	if name == "" {
+		name = req.URL.Query().Get("filename")
+	}
+	if name == "" {
+		return nil, NewHttpError(400, "Missing filename")
+	}
+
+	var src io.Reader = req.Body
+	var quota *uploadQuota
+	if h.Auth != nil {
+		token, _ := tokenFromContext(req.Context())
+		if len(token.AllowedMime) > 0 && !containsType(token.AllowedMime, req.Header.Get("Content-Type")) {
+			return nil, NewHttpError(415, "disallowed content type")
+		}
+		q, err := h.Auth.reserve(token)
+		if err != nil {
+			return nil, err
+		}
+		quota = q
+		src = quota.Wrap(req.Body)
+	}
+
+	filename := h.timestampFilename(name)
+	size, sum, err := h.writeUpload(src, filename)
+	if err != nil {
+		if quota != nil {
+			quota.Rollback()
+		}
+		return nil, err
+	}
+	if quota != nil {
+		quota.Commit()
+	}
+	logger.Printf("File uploaded: %s", filename)
+	h.dispatchUploadEvent(req, filename, size, sum, req.Header.Get("Content-Type"))
+
+	return &HttpResponse{200, "File uploaded"}, nil
+}
+
+// dispatchUploadEvent notifies any configured webhooks/SSE subscribers
+// about a completed upload, if event dispatch is enabled. The event carries
+// the uploading token's upload_id, if any, so /events subscribers only see
+// events for their own token.
+func (h *FileUploadHandler) dispatchUploadEvent(req *http.Request, filename string, size int64, sha256sum string, contentType string) {
+	if h.Events == nil {
+		return
+	}
+	var uploadID string
+	if token, ok := tokenFromContext(req.Context()); ok {
+		uploadID = token.UploadID
+	}
+	h.Events.Dispatch(UploadEvent{
+		UploadID:    uploadID,
+		Filename:    filename,
+		Size:        size,
+		SHA256:      sha256sum,
+		RemoteAddr:  req.RemoteAddr,
+		ContentType: contentType,
+		UploadedAt:  time.Now(),
+	})
+}
+
+// scanOutcome carries a scanner's result back from its goroutine.
+type scanOutcome struct {
+	result ScanResult
+	err    error
+}
+
+// writeUpload streams r into its final Storage location, hashing it with
+// sha256 along the way. Shared by the multipart and raw upload paths.
+// Returns the bytes written and their hex-encoded sha256.
+//
+// With no scanners configured, r is streamed straight into Storage.Create
+// with no local disk involved. Scanning, though, needs the whole file
+// before it can clear an upload, and a scanner's Scan(io.Reader) can't run
+// against an object store upload that's still in flight - so whenever
+// h.Scanners is non-empty, the upload is first staged under
+// UploadDir/.pending on local disk and only copied into Storage once every
+// scanner has cleared it. That local disk is still a hard capacity
+// requirement per in-flight upload in that case, even with an S3/GCS
+// backend configured.
+func (h *FileUploadHandler) writeUpload(r io.Reader, filename string) (int64, string, error) {
+	if len(h.Scanners) == 0 {
+		return h.streamUpload(r, filename)
+	}
+
+	if err := checkUploadDir(h.pendingDir()); err != nil {
+		return 0, "", err
+	}
+
+	pendingPath := fmt.Sprintf("%s/%s", h.pendingDir(), filename)
+	f, err := os.Create(pendingPath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	hasher := sha256.New()
+	writers := []io.Writer{f, hasher}
+	pipeWriters := make([]*io.PipeWriter, 0, len(h.Scanners))
+	results := make(chan scanOutcome, len(h.Scanners))
+	for _, scanner := range h.Scanners {
+		pr, pw := io.Pipe()
+		pipeWriters = append(pipeWriters, pw)
+		writers = append(writers, pw)
+		go func(scanner UploadScanner, pr *io.PipeReader) {
+			result, err := scanner.Scan(pr, filename)
+			io.Copy(io.Discard, pr)
+			results <- scanOutcome{result, err}
+		}(scanner, pr)
+	}
+
+	written, copyErr := io.Copy(io.MultiWriter(writers...), r)
+	for _, pw := range pipeWriters {
+		pw.Close()
+	}
+	f.Close()
+
+	var scanErr error
+	for range h.Scanners {
+		outcome := <-results
+		if outcome.err != nil && scanErr == nil {
+			scanErr = outcome.err
+		}
+		if outcome.err == nil && !outcome.result.Clean && scanErr == nil {
+			scanErr = NewHttpError(422, outcome.result.Verdict)
+		}
+	}
+
+	if copyErr != nil {
+		os.Remove(pendingPath)
+		return 0, "", copyErr
+	}
+	if scanErr != nil {
+		os.Remove(pendingPath)
+		return 0, "", scanErr
+	}
+
+	if err := h.commitToStorage(pendingPath, filename); err != nil {
+		return 0, "", err
+	}
+	return written, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// streamUpload copies r straight into the Storage backend, hashing it with
+// sha256 along the way, with no local disk staging. Used by writeUpload
+// when there's no scanner chain to satisfy first.
+func (h *FileUploadHandler) streamUpload(r io.Reader, filename string) (int64, string, error) {
+	dst, err := h.Storage.Create(filename)
+	if err != nil {
+		return 0, "", err
+	}
+
+	hasher := sha256.New()
+	written, copyErr := io.Copy(dst, io.TeeReader(r, hasher))
+	closeErr := dst.Close()
+
+	if copyErr != nil {
+		h.Storage.Delete(filename)
+		return 0, "", copyErr
+	}
+	if closeErr != nil {
+		h.Storage.Delete(filename)
+		return 0, "", closeErr
+	}
+
+	return written, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// commitToStorage moves a file that has cleared scanning out of local
+// pending storage and into the configured Storage backend, which may be
+// local disk, S3, or GCS.
+func (h *FileUploadHandler) commitToStorage(pendingPath, filename string) error {
+	src, err := os.Open(pendingPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := h.Storage.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(pendingPath)
+}
+
+func (h *FileUploadHandler) pendingDir() string {
+	return fmt.Sprintf("%s/.pending", h.UploadDir)
+}
+
 func (h *FileUploadHandler) createFilename(part *multipart.Part) string {
-	ts := time.Now().Unix()
-	return fmt.Sprintf("%d-%s", ts, part.FileName())
+	return h.timestampFilename(part.FileName())
 }
 
-func (h *FileUploadHandler) createFile(filename string) (*os.File, error) {
-	return os.Create(fmt.Sprintf("%s/%s", h.UploadDir, filename))
+func (h *FileUploadHandler) timestampFilename(name string) string {
+	ts := time.Now().Unix()
+	return fmt.Sprintf("%d-%s", ts, name)
 }
 
 func main() {
-	err := start("0.0.0.0:4500", "./uploads")
+	scannerNames := flag.String("scanner", envOr("AIR_SENDER_SCANNERS", ""), "comma separated list of scanners to run on each upload (clamav,mime)")
+	clamavAddr := flag.String("clamav-addr", envOr("AIR_SENDER_CLAMAV_ADDR", "tcp://127.0.0.1:3310"), "clamd INSTREAM address")
+	mimeMaxBytes := flag.Int64("mime-max-bytes", envOrInt64("AIR_SENDER_MIME_MAX_BYTES", 1<<30), "max file size in bytes enforced by the mime scanner")
+	mimeAllowedTypes := flag.String("mime-allowed-types", envOr("AIR_SENDER_MIME_ALLOWED_TYPES", ""), "comma separated allowlist of sniffed content types enforced by the mime scanner (empty allows any)")
+	storageSpec := flag.String("storage", envOr("AIR_SENDER_STORAGE", "./uploads"), "storage backend for uploaded files: a local directory, or s3://bucket/prefix, gs://bucket/prefix")
+	webhooks := flag.String("webhooks", envOr("AIR_SENDER_WEBHOOKS", ""), "comma separated webhook URLs notified after each upload")
+	flag.Parse()
+
+	scanners, err := buildScanners(*scannerNames, *clamavAddr, *mimeMaxBytes, *mimeAllowedTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := newStorage(*storageSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth := buildUploadAuth("./uploads")
+	events := buildEventDispatcher(*webhooks, "./uploads")
+
+	err = start("0.0.0.0:4500", "./uploads", scanners, auth, storage, events)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func start(addr string, uploadDir string) error {
+// buildEventDispatcher wires up webhook/SSE notifications. It's always
+// enabled, even with no webhook URLs configured, so the web UI can still
+// subscribe to /events.
+func buildEventDispatcher(webhooks string, uploadDir string) *EventDispatcher {
+	var urls []string
+	if webhooks != "" {
+		urls = strings.Split(webhooks, ",")
+	}
+	secret := []byte(os.Getenv("AIR_SENDER_WEBHOOK_SECRET"))
+	return NewEventDispatcher(urls, secret, uploadDir)
+}
+
+// buildUploadAuth wires up token authorization from the environment. Auth
+// is disabled (nil) unless AIR_SENDER_TOKEN_SECRET is set, so the uploader
+// still works wide open by default.
+func buildUploadAuth(uploadDir string) *UploadAuth {
+	secret := os.Getenv("AIR_SENDER_TOKEN_SECRET")
+	if secret == "" {
+		return nil
+	}
+	return &UploadAuth{
+		Secret: []byte(secret),
+		Store:  NewTokenStore(fmt.Sprintf("%s/.tokens.json", uploadDir)),
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func envOrInt64(key string, fallback int64) int64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// buildScanners turns the -scanner flag's comma separated names into the
+// configured UploadScanner chain. mimeMaxBytes and mimeAllowedTypes
+// configure the "mime" scanner's size cap and content-type allowlist.
+func buildScanners(names string, clamavAddr string, mimeMaxBytes int64, mimeAllowedTypes string) ([]UploadScanner, error) {
+	var scanners []UploadScanner
+	if names == "" {
+		return scanners, nil
+	}
+	var allowedTypes []string
+	if mimeAllowedTypes != "" {
+		allowedTypes = strings.Split(mimeAllowedTypes, ",")
+	}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "clamav":
+			addr := strings.TrimPrefix(clamavAddr, "tcp://")
+			scanners = append(scanners, &ClamAVScanner{Addr: addr})
+		case "mime":
+			scanners = append(scanners, &MimeScanner{
+				MaxBytes:     mimeMaxBytes,
+				AllowedTypes: allowedTypes,
+			})
+		default:
+			return nil, fmt.Errorf("unknown scanner: %s", name)
+		}
+	}
+	return scanners, nil
+}
+
+func start(addr string, uploadDir string, scanners []UploadScanner, auth *UploadAuth, storage Storage, events *EventDispatcher) error {
 	err := checkUploadDir(uploadDir)
 	if err != nil {
 		return err
 	}
+
+	fileUploadHandler := &FileUploadHandler{UploadDir: uploadDir, Scanners: scanners, Auth: auth, Storage: storage, Events: events}
+	uploadHandler := http.Handler(fileUploadHandler)
+	tusHandler := http.Handler(&TusUploadHandler{UploadDir: uploadDir, Uploads: fileUploadHandler})
+	// /events exposes per-upload filenames, sizes, hashes and uploader
+	// addresses, so it gets the same token gate as /upload and /files/
+	// whenever auth is configured.
+	eventsHandler := http.Handler(&EventStreamHandler{Dispatcher: events})
+	if auth != nil {
+		uploadHandler = auth.RequireToken(uploadHandler)
+		tusHandler = auth.RequireToken(tusHandler)
+		eventsHandler = auth.RequireToken(eventsHandler)
+		http.Handle("/tokens", &mintTokenHandler{AdminKey: os.Getenv("AIR_SENDER_ADMIN_KEY"), Secret: auth.Secret})
+	}
+
 	http.Handle("/", http.FileServer(http.Dir("./public")))
-	http.Handle("/upload", &FileUploadHandler{uploadDir})
+	http.Handle("/upload", uploadHandler)
+	http.Handle("/files/", tusHandler)
+	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(&storageFileSystem{storage: storage})))
+	http.Handle("/events", eventsHandler)
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
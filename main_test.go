@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestBuildScannersThreadsMimeConfig(t *testing.T) {
+	scanners, err := buildScanners("mime", "", 42, "image/png,image/jpeg")
+	if err != nil {
+		t.Fatalf("buildScanners: %v", err)
+	}
+	if len(scanners) != 1 {
+		t.Fatalf("got %d scanners, want 1", len(scanners))
+	}
+	mime, ok := scanners[0].(*MimeScanner)
+	if !ok {
+		t.Fatalf("scanner type = %T, want *MimeScanner", scanners[0])
+	}
+	if mime.MaxBytes != 42 {
+		t.Fatalf("MaxBytes = %d, want 42", mime.MaxBytes)
+	}
+	if len(mime.AllowedTypes) != 2 || mime.AllowedTypes[0] != "image/png" || mime.AllowedTypes[1] != "image/jpeg" {
+		t.Fatalf("AllowedTypes = %+v, want [image/png image/jpeg]", mime.AllowedTypes)
+	}
+}
+
+func TestBuildScannersUnknownScanner(t *testing.T) {
+	if _, err := buildScanners("bogus", "", 0, ""); err == nil {
+		t.Fatal("expected an error for an unknown scanner name")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteUploadStreamsDirectlyWithNoScanners(t *testing.T) {
+	dir := t.TempDir()
+	h := &FileUploadHandler{UploadDir: dir, Storage: &LocalStorage{Dir: dir}}
+	content := []byte("no scanners, no local hop")
+
+	size, sum, err := h.writeUpload(bytes.NewReader(content), "direct.txt")
+	if err != nil {
+		t.Fatalf("writeUpload: %v", err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("size = %d, want %d", size, len(content))
+	}
+	want := sha256.Sum256(content)
+	if sum != hex.EncodeToString(want[:]) {
+		t.Fatalf("sha256 = %s, want %s", sum, hex.EncodeToString(want[:]))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "direct.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatalf("stored contents = %q, want %q", data, content)
+	}
+
+	// No .pending staging directory should have been created.
+	if _, err := os.Stat(filepath.Join(dir, ".pending")); !os.IsNotExist(err) {
+		t.Fatalf("expected no .pending dir, stat err = %v", err)
+	}
+}
+
+func TestWriteUploadStillStagesLocallyWithScanners(t *testing.T) {
+	dir := t.TempDir()
+	h := &FileUploadHandler{
+		UploadDir: dir,
+		Storage:   &LocalStorage{Dir: dir},
+		Scanners:  []UploadScanner{&MimeScanner{}},
+	}
+	content := []byte("scanned upload")
+
+	if _, _, err := h.writeUpload(bytes.NewReader(content), "scanned.txt"); err != nil {
+		t.Fatalf("writeUpload: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".pending")); err != nil {
+		t.Fatalf("expected a .pending staging dir when scanners are configured: %v", err)
+	}
+}
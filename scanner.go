@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ScanResult is the verdict a UploadScanner reaches after inspecting an
+// upload's contents.
+type ScanResult struct {
+	Clean   bool
+	Verdict string
+}
+
+// UploadScanner inspects an uploaded file's bytes before it is committed to
+// its final location.
+type UploadScanner interface {
+	Scan(r io.Reader, filename string) (ScanResult, error)
+}
+
+// ClamAVScanner submits a file to a clamd daemon over the INSTREAM protocol.
+type ClamAVScanner struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+func (s *ClamAVScanner) Scan(r io.Reader, filename string) (ScanResult, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, timeout)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			size := make([]byte, 4)
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return ScanResult{}, werr
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return ScanResult{}, werr
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return ScanResult{}, err
+			}
+			break
+		}
+	}
+	// zero-length chunk terminates the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	reply = strings.TrimRight(reply, "\x00")
+
+	if strings.Contains(reply, "FOUND") {
+		return ScanResult{Clean: false, Verdict: reply}, nil
+	}
+	if strings.Contains(reply, "stream: OK") {
+		return ScanResult{Clean: true, Verdict: reply}, nil
+	}
+	return ScanResult{}, fmt.Errorf("unexpected clamd reply: %s", reply)
+}
+
+// MimeScanner rejects uploads over a size limit or whose sniffed content
+// type isn't in an allowlist.
+type MimeScanner struct {
+	MaxBytes     int64
+	AllowedTypes []string
+}
+
+func (s *MimeScanner) Scan(r io.Reader, filename string) (ScanResult, error) {
+	limit := s.MaxBytes
+	if limit <= 0 {
+		limit = 1 << 30 // 1 GiB default ceiling
+	}
+
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(r, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ScanResult{}, err
+	}
+	sniff = sniff[:n]
+	total := int64(n)
+
+	if len(s.AllowedTypes) > 0 {
+		contentType := http.DetectContentType(sniff)
+		if !containsType(s.AllowedTypes, contentType) {
+			return ScanResult{Clean: false, Verdict: fmt.Sprintf("disallowed content type: %s", contentType)}, nil
+		}
+	}
+
+	written, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	total += written
+	if total > limit {
+		return ScanResult{Clean: false, Verdict: fmt.Sprintf("file exceeds max size of %d bytes", limit)}, nil
+	}
+
+	return ScanResult{Clean: true, Verdict: "ok"}, nil
+}
+
+func containsType(allowed []string, contentType string) bool {
+	for _, t := range allowed {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
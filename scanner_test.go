@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMimeScannerAllowsAllowedType(t *testing.T) {
+	s := &MimeScanner{AllowedTypes: []string{"text/plain; charset=utf-8"}}
+	result, err := s.Scan(strings.NewReader("just some plain text"), "note.txt")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !result.Clean {
+		t.Fatalf("expected a clean verdict, got %+v", result)
+	}
+}
+
+func TestMimeScannerRejectsDisallowedType(t *testing.T) {
+	s := &MimeScanner{AllowedTypes: []string{"image/png"}}
+	result, err := s.Scan(strings.NewReader("just some plain text"), "note.txt")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if result.Clean {
+		t.Fatalf("expected a dirty verdict for a disallowed content type, got %+v", result)
+	}
+}
+
+func TestMimeScannerRejectsOversizedFile(t *testing.T) {
+	s := &MimeScanner{MaxBytes: 10}
+	result, err := s.Scan(bytes.NewReader(bytes.Repeat([]byte("a"), 20)), "big.txt")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if result.Clean {
+		t.Fatalf("expected a dirty verdict for an oversized file, got %+v", result)
+	}
+}
+
+func TestMimeScannerDefaultAllowsAnyType(t *testing.T) {
+	s := &MimeScanner{}
+	result, err := s.Scan(strings.NewReader("anything goes"), "file.bin")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if !result.Clean {
+		t.Fatalf("expected a clean verdict with no AllowedTypes configured, got %+v", result)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// StorageInfo is the subset of file metadata every Storage backend can
+// report, regardless of whether it's backed by a local disk or an object
+// store.
+type StorageInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage abstracts where uploaded (and served) files actually live, so the
+// upload handlers and the download file server can both work against local
+// disk, S3, or GCS without caring which.
+type Storage interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (StorageInfo, error)
+	Delete(name string) error
+}
+
+// LocalStorage is the original on-disk behavior, kept as the default
+// backend.
+type LocalStorage struct {
+	Dir string
+}
+
+func (s *LocalStorage) path(name string) string {
+	return fmt.Sprintf("%s/%s", s.Dir, strings.TrimPrefix(name, "/"))
+}
+
+func (s *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	return os.Create(s.path(name))
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) Stat(name string) (StorageInfo, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// newStorage selects a Storage backend from a `-storage` flag value, e.g.
+// "s3://bucket/prefix", "gs://bucket/prefix", or a plain local directory
+// path such as "./uploads".
+func newStorage(spec string) (Storage, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" {
+		return &LocalStorage{Dir: spec}, nil
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return NewS3Storage(u.Host, prefix)
+	case "gs":
+		return NewGCSStorage(u.Host, prefix)
+	default:
+		return nil, fmt.Errorf("unknown storage scheme: %s", u.Scheme)
+	}
+}
+
+// storageFileSystem adapts a Storage backend to http.FileSystem so it can be
+// served with http.FileServer, the same way ./public and ./uploads are
+// served today.
+type storageFileSystem struct {
+	storage Storage
+}
+
+func (fs *storageFileSystem) Open(name string) (http.File, error) {
+	info, err := fs.storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := fs.storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &storageFile{ReadCloser: r, info: info}, nil
+}
+
+// storageFile implements http.File for a single object. It does not support
+// directory listings or arbitrary seeks (object storage reads are one-shot
+// streams): only Seek(0, io.SeekStart) works, which is all http.FileServer
+// needs to retry a Range request from the start.
+type storageFile struct {
+	io.ReadCloser
+	info StorageInfo
+	read int64
+}
+
+func (f *storageFile) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	f.read += int64(n)
+	return n, err
+}
+
+func (f *storageFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart && f.read == 0 {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("storageFile: seeking within object storage reads is not supported")
+}
+
+func (f *storageFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("storageFile: directory listing is not supported")
+}
+
+func (f *storageFile) Stat() (os.FileInfo, error) {
+	return &storageFileInfo{f.info}, nil
+}
+
+type storageFileInfo struct {
+	info StorageInfo
+}
+
+func (i *storageFileInfo) Name() string       { return i.info.Name }
+func (i *storageFileInfo) Size() int64        { return i.info.Size }
+func (i *storageFileInfo) Mode() os.FileMode  { return 0644 }
+func (i *storageFileInfo) ModTime() time.Time { return i.info.ModTime }
+func (i *storageFileInfo) IsDir() bool        { return false }
+func (i *storageFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCSStorage stores files in a Google Cloud Storage bucket.
+type GCSStorage struct {
+	Bucket string
+	Prefix string
+	client *storage.Client
+}
+
+func NewGCSStorage(bucket, prefix string) (*GCSStorage, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &GCSStorage{Bucket: bucket, Prefix: prefix, client: client}, nil
+}
+
+func (s *GCSStorage) object(name string) *storage.ObjectHandle {
+	return s.client.Bucket(s.Bucket).Object(s.key(name))
+}
+
+func (s *GCSStorage) key(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if s.Prefix == "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", s.Prefix, name)
+}
+
+func (s *GCSStorage) Create(name string) (io.WriteCloser, error) {
+	return s.object(name).NewWriter(context.Background()), nil
+}
+
+func (s *GCSStorage) Open(name string) (io.ReadCloser, error) {
+	return s.object(name).NewReader(context.Background())
+}
+
+func (s *GCSStorage) Stat(name string) (StorageInfo, error) {
+	attrs, err := s.object(name).Attrs(context.Background())
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: name, Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+func (s *GCSStorage) Delete(name string) error {
+	return s.object(name).Delete(context.Background())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3Storage stores files in an S3-compatible bucket, uploading through
+// manager.Uploader so large files are flushed in 5 MiB parts instead of
+// buffered whole in memory.
+type S3Storage struct {
+	Bucket   string
+	Prefix   string
+	client   *s3.Client
+	uploader *manager.Uploader
+}
+
+func NewS3Storage(bucket, prefix string) (*S3Storage, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg)
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = 5 * 1024 * 1024
+	})
+	return &S3Storage{Bucket: bucket, Prefix: prefix, client: client, uploader: uploader}, nil
+}
+
+func (s *S3Storage) key(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if s.Prefix == "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", s.Prefix, name)
+}
+
+// Create returns a writer that streams directly into S3 via a multipart
+// upload; the upload only completes once the writer is closed.
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := s.uploader.Upload(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.key(name)),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return &s3Writer{pw: pw, done: done}, nil
+}
+
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3Storage) Stat(name string) (StorageInfo, error) {
+	out, err := s.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	info := StorageInfo{Name: name}
+	if out.ContentLength != nil {
+		info.Size = *out.ContentLength
+	}
+	if out.LastModified != nil {
+		info.ModTime = *out.LastModified
+	}
+	return info, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tusResumableVersion = "1.0.0"
+
+// TusUploadHandler implements the tus 1.0.0 resumable upload protocol
+// (https://tus.io/protocols/resumable-upload), so that flaky clients can
+// resume an interrupted transfer instead of restarting from scratch. A
+// finished upload is handed off to Uploads so it goes through the same
+// scanning, storage and event dispatch pipeline as /upload, rather than
+// writing straight to local disk.
+type TusUploadHandler struct {
+	UploadDir string
+	Uploads   *FileUploadHandler
+}
+
+// tusUpload is the sidecar JSON persisted alongside each in-progress upload.
+type tusUpload struct {
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (h *TusUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := &RequestLogger{r}
+	res, err := h.handleTusUpload(w, r)
+	if res != nil {
+		w.WriteHeader(res.StatusCode)
+		if _, err := w.Write([]byte(res.Message)); err != nil {
+			logger.Print(err)
+		}
+		return
+	}
+	if err == nil {
+		return
+	}
+	logger.Print(err)
+	code := 500
+	message := "Internal server error"
+	if v, ok := err.(*HttpError); ok {
+		code = v.StatusCode
+		message = v.Message
+	}
+	w.WriteHeader(code)
+	if _, err := w.Write([]byte(message)); err != nil {
+		logger.Print(err)
+	}
+}
+
+func (h *TusUploadHandler) handleTusUpload(w http.ResponseWriter, r *http.Request) (*HttpResponse, error) {
+	w.Header().Set("Tus-Resumable", tusResumableVersion)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusResumableVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		return &HttpResponse{204, ""}, nil
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/files/"), "/")
+
+	switch r.Method {
+	case "POST":
+		if id != "" {
+			return nil, NewHttpError(404, "Not Found")
+		}
+		return h.createUpload(w, r)
+	case "HEAD":
+		return h.headUpload(w, id)
+	case "PATCH":
+		return h.patchUpload(w, r, id)
+	case "DELETE":
+		return h.deleteUpload(r, id)
+	default:
+		return nil, NewHttpError(404, "Not Found")
+	}
+}
+
+func (h *TusUploadHandler) createUpload(w http.ResponseWriter, r *http.Request) (*HttpResponse, error) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, NewHttpError(400, "Missing or invalid Upload-Length")
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return nil, NewHttpError(400, "Invalid Upload-Metadata")
+	}
+
+	if token, ok := tokenFromContext(r.Context()); ok {
+		if token.MaxBytes > 0 && length > token.MaxBytes {
+			return nil, NewHttpError(413, "upload exceeds token's max_bytes quota")
+		}
+		if ct := metadata["filetype"]; ct != "" && len(token.AllowedMime) > 0 && !containsType(token.AllowedMime, ct) {
+			return nil, NewHttpError(415, "disallowed content type")
+		}
+		// Claim a file slot and the token's remaining byte budget up front,
+		// the same reserve-before-write pattern writeUpload's callers use,
+		// so the per-token quotas also bound the tus path. The slot is
+		// released on completeUpload failure or DELETE, and the bytes are
+		// charged once the upload actually finishes.
+		if h.Uploads.Auth != nil {
+			remaining, err := h.Uploads.Auth.Store.ReserveFile(token.UploadID, token)
+			if err != nil {
+				return nil, err
+			}
+			if length > remaining {
+				h.Uploads.Auth.Store.ReleaseFile(token.UploadID)
+				return nil, NewHttpError(413, "upload exceeds token's remaining max_bytes quota")
+			}
+		}
+	}
+
+	if err := h.ensurePendingDir(); err != nil {
+		return nil, err
+	}
+
+	id, err := generateUploadID()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(h.dataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	upload := tusUpload{Length: length, Metadata: metadata}
+	if err := h.writeSidecar(id, upload); err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/files/%s", id))
+	return &HttpResponse{201, ""}, nil
+}
+
+func (h *TusUploadHandler) headUpload(w http.ResponseWriter, id string) (*HttpResponse, error) {
+	upload, err := h.readSidecar(id)
+	if err != nil {
+		return nil, NewHttpError(404, "Not Found")
+	}
+
+	info, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	return &HttpResponse{200, ""}, nil
+}
+
+func (h *TusUploadHandler) patchUpload(w http.ResponseWriter, r *http.Request, id string) (*HttpResponse, error) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return nil, NewHttpError(415, "Unsupported Content-Type")
+	}
+
+	upload, err := h.readSidecar(id)
+	if err != nil {
+		return nil, NewHttpError(404, "Not Found")
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return nil, NewHttpError(400, "Missing or invalid Upload-Offset")
+	}
+
+	info, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if offset != info.Size() {
+		return nil, NewHttpError(409, "Upload-Offset does not match current size")
+	}
+
+	f, err := os.OpenFile(h.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Cap the write at the declared Upload-Length: read one byte past the
+	// remaining budget so a client that sends too much is detected (rather
+	// than silently accepted) instead of growing the pending file forever.
+	remaining := upload.Length - offset
+	n, err := io.Copy(f, io.LimitReader(r.Body, remaining+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > remaining {
+		f.Truncate(offset + remaining)
+		return nil, NewHttpError(400, "PATCH body exceeds declared Upload-Length")
+	}
+
+	newOffset := offset + n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+
+	if newOffset == upload.Length {
+		if err := h.completeUpload(r, id, upload); err != nil {
+			return nil, err
+		}
+	}
+
+	return &HttpResponse{204, ""}, nil
+}
+
+func (h *TusUploadHandler) deleteUpload(r *http.Request, id string) (*HttpResponse, error) {
+	if _, err := h.readSidecar(id); err != nil {
+		return nil, NewHttpError(404, "Not Found")
+	}
+	if h.Uploads.Auth != nil {
+		if token, ok := tokenFromContext(r.Context()); ok {
+			h.Uploads.Auth.Store.ReleaseFile(token.UploadID)
+		}
+	}
+	os.Remove(h.dataPath(id))
+	os.Remove(h.sidecarPath(id))
+	return &HttpResponse{204, ""}, nil
+}
+
+// completeUpload hands a finished upload's bytes to Uploads.writeUpload, so
+// it passes through the same scanning chain, Storage backend and sha256
+// hashing as the multipart/raw upload paths, then dispatches the same
+// upload event and cleans up the tus staging files. It charges the actual
+// bytes written against the reservation createUpload made, or releases the
+// reservation's file slot if the upload fails.
+func (h *TusUploadHandler) completeUpload(r *http.Request, id string, upload tusUpload) error {
+	name := upload.Metadata["filename"]
+	if name == "" {
+		name = id
+	}
+	filename := fmt.Sprintf("%d-%s", time.Now().Unix(), name)
+
+	src, err := os.Open(h.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	size, sum, err := h.Uploads.writeUpload(src, filename)
+	if err != nil {
+		if h.Uploads.Auth != nil {
+			if token, ok := tokenFromContext(r.Context()); ok {
+				h.Uploads.Auth.Store.ReleaseFile(token.UploadID)
+			}
+		}
+		return err
+	}
+	if h.Uploads.Auth != nil {
+		if token, ok := tokenFromContext(r.Context()); ok {
+			h.Uploads.Auth.Store.CommitBytes(token.UploadID, size)
+		}
+	}
+
+	os.Remove(h.dataPath(id))
+	os.Remove(h.sidecarPath(id))
+
+	h.Uploads.dispatchUploadEvent(r, filename, size, sum, upload.Metadata["filetype"])
+	return nil
+}
+
+func (h *TusUploadHandler) pendingDir() string {
+	return fmt.Sprintf("%s/.pending-tus", h.UploadDir)
+}
+
+func (h *TusUploadHandler) ensurePendingDir() error {
+	return checkUploadDir(h.pendingDir())
+}
+
+func (h *TusUploadHandler) dataPath(id string) string {
+	return fmt.Sprintf("%s/%s", h.pendingDir(), id)
+}
+
+func (h *TusUploadHandler) sidecarPath(id string) string {
+	return fmt.Sprintf("%s/%s.json", h.pendingDir(), id)
+}
+
+func (h *TusUploadHandler) writeSidecar(id string, upload tusUpload) error {
+	f, err := os.Create(h.sidecarPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(upload)
+}
+
+func (h *TusUploadHandler) readSidecar(id string) (tusUpload, error) {
+	var upload tusUpload
+	if id == "" {
+		return upload, fmt.Errorf("missing upload id")
+	}
+	f, err := os.Open(h.sidecarPath(id))
+	if err != nil {
+		return upload, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&upload)
+	return upload, err
+}
+
+// generateUploadID produces a random hex identifier for a new upload.
+func generateUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header, a comma
+// separated list of "key base64value" pairs.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		key := parts[0]
+		if len(parts) == 1 {
+			metadata[key] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
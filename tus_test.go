@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	header := "filename " + base64.StdEncoding.EncodeToString([]byte("report.pdf")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("application/pdf"))
+
+	metadata, err := parseUploadMetadata(header)
+	if err != nil {
+		t.Fatalf("parseUploadMetadata: %v", err)
+	}
+	if metadata["filename"] != "report.pdf" {
+		t.Fatalf("filename = %q, want %q", metadata["filename"], "report.pdf")
+	}
+	if metadata["filetype"] != "application/pdf" {
+		t.Fatalf("filetype = %q, want %q", metadata["filetype"], "application/pdf")
+	}
+}
+
+func TestParseUploadMetadataEmpty(t *testing.T) {
+	metadata, err := parseUploadMetadata("")
+	if err != nil {
+		t.Fatalf("parseUploadMetadata: %v", err)
+	}
+	if len(metadata) != 0 {
+		t.Fatalf("expected empty metadata, got %+v", metadata)
+	}
+}
+
+func TestParseUploadMetadataInvalidBase64(t *testing.T) {
+	if _, err := parseUploadMetadata("filename not-valid-base64!!"); err == nil {
+		t.Fatal("expected an error for invalid base64 metadata value")
+	}
+}
+
+func newTestTusHandler(t *testing.T) (*TusUploadHandler, string) {
+	t.Helper()
+	uploadDir := t.TempDir()
+	uploads := &FileUploadHandler{UploadDir: uploadDir, Storage: &LocalStorage{Dir: uploadDir}}
+	return &TusUploadHandler{UploadDir: uploadDir, Uploads: uploads}, uploadDir
+}
+
+// newTestTusHandlerWithAuth wires in an UploadAuth the way start() does, so
+// tus requests need a token in their context, like RequireToken supplies.
+func newTestTusHandlerWithAuth(t *testing.T) (*TusUploadHandler, *UploadAuth) {
+	t.Helper()
+	uploadDir := t.TempDir()
+	auth := &UploadAuth{
+		Secret: []byte("test-secret"),
+		Store:  NewTokenStore(filepath.Join(uploadDir, ".tokens.json")),
+	}
+	uploads := &FileUploadHandler{UploadDir: uploadDir, Storage: &LocalStorage{Dir: uploadDir}, Auth: auth}
+	return &TusUploadHandler{UploadDir: uploadDir, Uploads: uploads}, auth
+}
+
+func requestWithToken(req *http.Request, token UploadToken) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), tokenContextKey{}, token))
+}
+
+// TestTusUploadLifecycle drives the create -> patch -> complete state
+// machine end to end, across two PATCH requests split at an arbitrary
+// offset, the way a resuming client would.
+func TestTusUploadLifecycle(t *testing.T) {
+	h, uploadDir := newTestTusHandler(t)
+	content := []byte("hello, resumable world")
+
+	createReq := httptest.NewRequest("POST", "/files/", nil)
+	createReq.Header.Set("Upload-Length", strconv.Itoa(len(content)))
+	createReq.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("greeting.txt")))
+	createRec := httptest.NewRecorder()
+	h.ServeHTTP(createRec, createReq)
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, body %q", createRec.Code, createRec.Body.String())
+	}
+	location := createRec.Header().Get("Location")
+	if location == "" {
+		t.Fatal("expected a Location header from create")
+	}
+
+	split := 10
+	firstPart, secondPart := content[:split], content[split:]
+
+	patch1 := httptest.NewRequest("PATCH", location, bytes.NewReader(firstPart))
+	patch1.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch1.Header.Set("Upload-Offset", "0")
+	rec1 := httptest.NewRecorder()
+	h.ServeHTTP(rec1, patch1)
+	if rec1.Code != http.StatusNoContent {
+		t.Fatalf("first patch status = %d, body %q", rec1.Code, rec1.Body.String())
+	}
+	if got := rec1.Header().Get("Upload-Offset"); got != strconv.Itoa(split) {
+		t.Fatalf("Upload-Offset after first patch = %q, want %q", got, strconv.Itoa(split))
+	}
+
+	// A PATCH at the wrong offset must be rejected, not silently applied.
+	staleRetry := httptest.NewRequest("PATCH", location, bytes.NewReader(firstPart))
+	staleRetry.Header.Set("Content-Type", "application/offset+octet-stream")
+	staleRetry.Header.Set("Upload-Offset", "0")
+	staleRec := httptest.NewRecorder()
+	h.ServeHTTP(staleRec, staleRetry)
+	if staleRec.Code != http.StatusConflict {
+		t.Fatalf("stale patch status = %d, want 409", staleRec.Code)
+	}
+
+	patch2 := httptest.NewRequest("PATCH", location, bytes.NewReader(secondPart))
+	patch2.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch2.Header.Set("Upload-Offset", strconv.Itoa(split))
+	rec2 := httptest.NewRecorder()
+	h.ServeHTTP(rec2, patch2)
+	if rec2.Code != http.StatusNoContent {
+		t.Fatalf("second patch status = %d, body %q", rec2.Code, rec2.Body.String())
+	}
+	if got := rec2.Header().Get("Upload-Offset"); got != strconv.Itoa(len(content)) {
+		t.Fatalf("Upload-Offset after second patch = %q, want %q", got, strconv.Itoa(len(content)))
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var found bool
+	for _, e := range entries {
+		if !e.IsDir() && bytes.Contains([]byte(e.Name()), []byte("greeting.txt")) {
+			found = true
+			data, err := os.ReadFile(uploadDir + "/" + e.Name())
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Fatalf("committed file contents = %q, want %q", data, content)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected the completed upload to be committed to storage under its filename")
+	}
+}
+
+// TestTusPatchRejectsOverLength confirms a PATCH body larger than the
+// declared Upload-Length is rejected rather than silently appended past it.
+func TestTusPatchRejectsOverLength(t *testing.T) {
+	h, uploadDir := newTestTusHandler(t)
+
+	createReq := httptest.NewRequest("POST", "/files/", nil)
+	createReq.Header.Set("Upload-Length", "5")
+	createRec := httptest.NewRecorder()
+	h.ServeHTTP(createRec, createReq)
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, body %q", createRec.Code, createRec.Body.String())
+	}
+	location := createRec.Header().Get("Location")
+
+	oversized := bytes.Repeat([]byte("a"), 1000)
+	patch := httptest.NewRequest("PATCH", location, bytes.NewReader(oversized))
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, patch)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("patch status = %d, want 400", rec.Code)
+	}
+
+	info, err := os.Stat(fmt.Sprintf("%s/.pending-tus/%s", uploadDir, strings.TrimPrefix(location, "/files/")))
+	if err != nil {
+		t.Fatalf("Stat pending upload: %v", err)
+	}
+	if info.Size() != 5 {
+		t.Fatalf("pending upload size = %d, want it capped at the declared Upload-Length of 5", info.Size())
+	}
+}
+
+// TestTusUploadChargesTokenQuota confirms a completed tus upload claims a
+// file slot up front and charges its bytes against the token's quota, the
+// same reserve/commit pattern the multipart and raw upload paths use.
+func TestTusUploadChargesTokenQuota(t *testing.T) {
+	h, auth := newTestTusHandlerWithAuth(t)
+	token := UploadToken{UploadID: "u1", MaxBytes: 100, MaxFiles: 1}
+	content := []byte("hello tus quota")
+
+	createReq := requestWithToken(httptest.NewRequest("POST", "/files/", nil), token)
+	createReq.Header.Set("Upload-Length", strconv.Itoa(len(content)))
+	createRec := httptest.NewRecorder()
+	h.ServeHTTP(createRec, createReq)
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, body %q", createRec.Code, createRec.Body.String())
+	}
+	location := createRec.Header().Get("Location")
+
+	// A second upload under the same single-file token must be rejected
+	// while the first is still outstanding.
+	secondCreate := requestWithToken(httptest.NewRequest("POST", "/files/", nil), token)
+	secondCreate.Header.Set("Upload-Length", "1")
+	secondRec := httptest.NewRecorder()
+	h.ServeHTTP(secondRec, secondCreate)
+	if secondRec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("second create status = %d, want 413 (MaxFiles exhausted)", secondRec.Code)
+	}
+
+	patch := requestWithToken(httptest.NewRequest("PATCH", location, bytes.NewReader(content)), token)
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	patchRec := httptest.NewRecorder()
+	h.ServeHTTP(patchRec, patch)
+	if patchRec.Code != http.StatusNoContent {
+		t.Fatalf("patch status = %d, body %q", patchRec.Code, patchRec.Body.String())
+	}
+
+	remaining, err := auth.Store.ReserveFile("u1", UploadToken{UploadID: "u1", MaxBytes: 100, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("ReserveFile: %v", err)
+	}
+	if remaining != 100-int64(len(content)) {
+		t.Fatalf("remaining bytes after completed tus upload = %d, want %d", remaining, 100-int64(len(content)))
+	}
+}
+
+// TestTusDeleteReleasesTokenQuota confirms cancelling an in-progress tus
+// upload frees its reserved file slot instead of leaking it.
+func TestTusDeleteReleasesTokenQuota(t *testing.T) {
+	h, auth := newTestTusHandlerWithAuth(t)
+	token := UploadToken{UploadID: "u1", MaxFiles: 1}
+
+	createReq := requestWithToken(httptest.NewRequest("POST", "/files/", nil), token)
+	createReq.Header.Set("Upload-Length", "5")
+	createRec := httptest.NewRecorder()
+	h.ServeHTTP(createRec, createReq)
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, body %q", createRec.Code, createRec.Body.String())
+	}
+	location := createRec.Header().Get("Location")
+
+	deleteReq := requestWithToken(httptest.NewRequest("DELETE", location, nil), token)
+	deleteRec := httptest.NewRecorder()
+	h.ServeHTTP(deleteRec, deleteReq)
+	if deleteRec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, body %q", deleteRec.Code, deleteRec.Body.String())
+	}
+
+	if _, err := auth.Store.ReserveFile("u1", token); err != nil {
+		t.Fatalf("expected the file slot to be freed after DELETE, ReserveFile: %v", err)
+	}
+}
+
+func TestTusHeadUnknownUpload(t *testing.T) {
+	h, _ := newTestTusHandler(t)
+
+	req := httptest.NewRequest("HEAD", "/files/does-not-exist", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+}
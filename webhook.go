@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// UploadEvent describes a single completed upload, dispatched to webhooks
+// and SSE subscribers alike. UploadID is the token upload_id it was
+// uploaded under, if any, and is used to scope /events subscribers to their
+// own uploads.
+type UploadEvent struct {
+	UploadID    string    `json:"upload_id,omitempty"`
+	Filename    string    `json:"filename"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ContentType string    `json:"content_type"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// EventDispatcher fans a completed upload out to configured webhook URLs
+// (HMAC-signed, retried with backoff, logged on permanent failure) and to
+// any browsers subscribed to the /events SSE stream.
+type EventDispatcher struct {
+	Webhooks []string
+	Secret   []byte
+	LogPath  string
+
+	mu        sync.Mutex
+	listeners map[chan UploadEvent]string
+}
+
+func NewEventDispatcher(webhooks []string, secret []byte, uploadDir string) *EventDispatcher {
+	return &EventDispatcher{
+		Webhooks:  webhooks,
+		Secret:    secret,
+		LogPath:   fmt.Sprintf("%s/.events.log", uploadDir),
+		listeners: map[chan UploadEvent]string{},
+	}
+}
+
+// Dispatch broadcasts event to every SSE subscriber and, asynchronously, to
+// every configured webhook.
+func (d *EventDispatcher) Dispatch(event UploadEvent) {
+	d.broadcast(event)
+	for _, url := range d.Webhooks {
+		go d.deliver(url, event)
+	}
+}
+
+// broadcast delivers event to every subscriber whose uploadID scope is
+// empty (unscoped, for when auth is disabled) or matches the event's own
+// UploadID, so a token only ever observes its own uploads.
+func (d *EventDispatcher) broadcast(event UploadEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch, uploadID := range d.listeners {
+		if uploadID != "" && uploadID != event.UploadID {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// subscribe registers a new SSE listener, scoped to uploadID if non-empty.
+func (d *EventDispatcher) subscribe(uploadID string) chan UploadEvent {
+	ch := make(chan UploadEvent, 16)
+	d.mu.Lock()
+	d.listeners[ch] = uploadID
+	d.mu.Unlock()
+	return ch
+}
+
+func (d *EventDispatcher) unsubscribe(ch chan UploadEvent) {
+	d.mu.Lock()
+	delete(d.listeners, ch)
+	d.mu.Unlock()
+	close(ch)
+}
+
+// deliver POSTs event to url, retrying with exponential backoff, and falls
+// back to appending the event to LogPath if every attempt fails.
+func (d *EventDispatcher) deliver(url string, event UploadEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	mac := hmac.New(sha256.New, d.Secret)
+	mac.Write(payload)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	backoff := 500 * time.Millisecond
+	for attempt := 0; attempt < 5; attempt++ {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-AirSender-Signature", signature)
+			res, err := http.DefaultClient.Do(req)
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode < 300 {
+					return
+				}
+			}
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	d.logUndelivered(payload)
+}
+
+func (d *EventDispatcher) logUndelivered(payload []byte) {
+	f, err := os.OpenFile(d.LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer f.Close()
+	f.Write(payload)
+	f.Write([]byte("\n"))
+}
+
+// EventStreamHandler serves GET /events as a Server-Sent Events stream of
+// upload events, for the web UI's "just uploaded" feed. When the request
+// carries an upload token, the stream is scoped to that token's upload_id
+// so one token can't observe another uploader's events.
+type EventStreamHandler struct {
+	Dispatcher *EventDispatcher
+}
+
+func (h *EventStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	var uploadID string
+	if token, ok := tokenFromContext(r.Context()); ok {
+		uploadID = token.UploadID
+	}
+
+	ch := h.Dispatcher.subscribe(uploadID)
+	defer h.Dispatcher.unsubscribe(ch)
+
+	for {
+		select {
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
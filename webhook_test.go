@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestEventDispatcherBroadcastScopesToUploadID(t *testing.T) {
+	d := NewEventDispatcher(nil, nil, t.TempDir())
+
+	scoped := d.subscribe("u1")
+	defer d.unsubscribe(scoped)
+	unscoped := d.subscribe("")
+	defer d.unsubscribe(unscoped)
+	other := d.subscribe("u2")
+	defer d.unsubscribe(other)
+
+	d.Dispatch(UploadEvent{UploadID: "u1", Filename: "a.txt"})
+
+	select {
+	case event := <-scoped:
+		if event.Filename != "a.txt" {
+			t.Fatalf("scoped subscriber got %+v", event)
+		}
+	default:
+		t.Fatal("expected the u1-scoped subscriber to receive the u1 event")
+	}
+
+	select {
+	case event := <-unscoped:
+		if event.Filename != "a.txt" {
+			t.Fatalf("unscoped subscriber got %+v", event)
+		}
+	default:
+		t.Fatal("expected the unscoped subscriber to receive every event")
+	}
+
+	select {
+	case event := <-other:
+		t.Fatalf("u2-scoped subscriber should not receive a u1 event, got %+v", event)
+	default:
+	}
+}